@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultCacheDir is where DiskCache stores entries when main wires one up.
+const defaultCacheDir = ".cache"
+
+// CacheEntry is the small header stored alongside each cached response, so
+// a later run can make a conditional request and know what it already has.
+// The cached body on disk is always the raw bytes as they came over the
+// wire, before decompression, so ContentEncoding is recorded alongside it
+// to let a later cache hit run the same decompression as a live fetch.
+type CacheEntry struct {
+	ETag            string
+	LastModified    string
+	FetchedAt       time.Time
+	ContentHash     uint64
+	ContentEncoding string
+}
+
+// Cache is consulted before every HTTP fetch and populated on success.
+// Entries are staged to a temp file while the response streams through, then
+// committed once the fetch completes, so a cache write never requires
+// buffering the whole response in memory.
+type Cache interface {
+	// Get looks up rawURL and, if present, returns its entry and the path
+	// to the cached body.
+	Get(rawURL string) (entry CacheEntry, bodyPath string, ok bool)
+	// Stage returns a temp file to write a new body into.
+	Stage() (*os.File, error)
+	// Commit moves the staged file at tmpPath into the cache under rawURL's
+	// key and records entry alongside it.
+	Commit(rawURL string, entry CacheEntry, tmpPath string) error
+}
+
+// DiskCache is a content-addressable cache keyed by the xxhash of the URL
+// string. Entries live under dir/xx/xxxxxxxxxxxxxxxx{.json,.csv}, where xx
+// is the first byte of the hex-encoded hash.
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache returns a DiskCache rooted at dir.
+func NewDiskCache(dir string) *DiskCache {
+	return &DiskCache{dir: dir}
+}
+
+func cacheKey(rawURL string) string {
+	return fmt.Sprintf("%016x", xxhash64([]byte(rawURL)))
+}
+
+func (c *DiskCache) paths(key string) (headerPath, bodyPath string) {
+	base := filepath.Join(c.dir, key[:2], key)
+	return base + ".json", base + ".csv"
+}
+
+func (c *DiskCache) Get(rawURL string) (CacheEntry, string, bool) {
+	headerPath, bodyPath := c.paths(cacheKey(rawURL))
+	hb, err := os.ReadFile(headerPath)
+	if err != nil {
+		return CacheEntry{}, "", false
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(hb, &entry); err != nil {
+		return CacheEntry{}, "", false
+	}
+	if _, err := os.Stat(bodyPath); err != nil {
+		return CacheEntry{}, "", false
+	}
+	return entry, bodyPath, true
+}
+
+func (c *DiskCache) Stage() (*os.File, error) {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(c.dir, "stage-*")
+}
+
+func (c *DiskCache) Commit(rawURL string, entry CacheEntry, tmpPath string) error {
+	headerPath, bodyPath := c.paths(cacheKey(rawURL))
+	if err := os.MkdirAll(filepath.Dir(bodyPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, bodyPath); err != nil {
+		return err
+	}
+	hb, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(headerPath, hb, 0o644)
+}
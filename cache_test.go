@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func countEntries(t *testing.T, cache *DiskCache, u url.URL) (CacheEntry, bool) {
+	t.Helper()
+	entry, _, ok := cache.Get(u.String())
+	return entry, ok
+}
+
+// TestFetchHTTPNilCacheOn304DoesNotPanic reproduces the nil-pointer panic:
+// fetchHTTP is documented to accept a nil cache (the library-usage mode
+// with caching disabled), so a misbehaving origin sending a 304 despite no
+// conditional headers having been sent must be a clean error, not a crash.
+func TestFetchHTTPNilCacheOn304DoesNotPanic(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	u := url.URL{Scheme: "http", Host: "example.com", Path: "/users.csv"}
+	p := fetchHTTP(nil, nil, srv.URL, u, nil)
+	if p.err == nil {
+		t.Fatal("expected an error for a 304 with no cache configured")
+	}
+}
+
+// TestFetchHTTPCachesOnSuccess exercises the normal cache-miss-then-hit
+// path: a 200 populates the cache, and a subsequent 304 is served from it.
+func TestFetchHTTPCachesOnSuccess(t *testing.T) {
+	const csv = "fname, lname, age\nAda,Lovelace,36\n"
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Wed, 01 Jan 2025 00:00:00 GMT")
+		w.Write([]byte(csv))
+	}))
+	defer srv.Close()
+
+	cache := NewDiskCache(t.TempDir())
+	u := url.URL{Scheme: "http", Host: "example.com", Path: "/users.csv"}
+
+	p1 := fetchHTTP(cache, nil, srv.URL, u, nil)
+	if p1.err != nil {
+		t.Fatalf("first fetch: %v", p1.err)
+	}
+	if p1.numUsers != 1 {
+		t.Fatalf("first fetch: got %d users, want 1", p1.numUsers)
+	}
+
+	entry, ok := countEntries(t, cache, u)
+	if !ok {
+		t.Fatal("expected a cache entry after a clean fetch")
+	}
+	if entry.LastModified != "Wed, 01 Jan 2025 00:00:00 GMT" {
+		t.Errorf("LastModified = %q, want the origin's Last-Modified header", entry.LastModified)
+	}
+
+	p2 := fetchHTTP(cache, nil, srv.URL, u, nil)
+	if p2.err != nil {
+		t.Fatalf("second (304) fetch: %v", p2.err)
+	}
+	if p2.numUsers != 1 {
+		t.Fatalf("second (304) fetch: got %d users, want 1", p2.numUsers)
+	}
+	if hits != 2 {
+		t.Fatalf("server got %d requests, want 2", hits)
+	}
+}
+
+// TestFetchHTTPDoesNotCacheOnTruncatedRead reproduces the poisoning bug: a
+// connection that closes mid-body must not leave a cache entry behind, so
+// a later 304 can't replay the truncated bytes forever.
+func TestFetchHTTPDoesNotCacheOnTruncatedRead(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("fname, lname, age\nAda,Lovelace,36\n"))
+		// Declared Content-Length is never satisfied, so the client sees
+		// an unexpected-EOF reading the body instead of a clean io.EOF.
+	}))
+	defer srv.Close()
+
+	cache := NewDiskCache(t.TempDir())
+	u := url.URL{Scheme: "http", Host: "example.com", Path: "/users.csv"}
+
+	p := fetchHTTP(cache, nil, srv.URL, u, nil)
+	if p.err == nil {
+		t.Fatal("expected the truncated fetch to report an error")
+	}
+
+	if _, ok := countEntries(t, cache, u); ok {
+		t.Fatal("truncated fetch must not leave a cache entry behind")
+	}
+}
+
+// TestFetchHTTPCacheHitDecompresses reproduces the second cache bug: a
+// gzip-suffixed source cached on a 200 must still be decompressed when
+// served from a later 304, not handed raw to the CSV parser.
+func TestFetchHTTPCacheHitDecompresses(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("fname, lname, age\nAda,Lovelace,36\n"))
+	gw.Close()
+	gz := buf.Bytes()
+
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(gz)
+	}))
+	defer srv.Close()
+
+	cache := NewDiskCache(t.TempDir())
+	u := url.URL{Scheme: "http", Host: "example.com", Path: "/users.csv.gz"}
+
+	p1 := fetchHTTP(cache, nil, srv.URL, u, nil)
+	if p1.err != nil {
+		t.Fatalf("first fetch: %v", p1.err)
+	}
+	if p1.numUsers != 1 {
+		t.Fatalf("first fetch: got %d users, want 1", p1.numUsers)
+	}
+
+	p2 := fetchHTTP(cache, nil, srv.URL, u, nil)
+	if p2.err != nil {
+		t.Fatalf("second (304, cached) fetch: %v", p2.err)
+	}
+	if p2.numUsers != 1 {
+		t.Fatalf("second (304, cached) fetch: got %d users, want 1", p2.numUsers)
+	}
+	if hits != 2 {
+		t.Fatalf("server got %d requests, want 2", hits)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// wrappedBody pairs an arbitrary Reader with a Closer, so a fetcher can
+// swap in a decorated Reader (counting, throttling, teeing to a cache)
+// while still closing the original response body.
+type wrappedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// countingBody tallies every byte read through it into n, so callers can
+// learn how many bytes a fetch actually transferred over the wire.
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		atomic.AddInt64(c.n, int64(n))
+	}
+	return n, err
+}
+
+// tokenBucket is a classic token-bucket rate limiter: tokens refill
+// continuously at rate per second up to capacity, and take blocks (by
+// returning how long to sleep) once they run out.
+type tokenBucket struct {
+	mtx      sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(ratePerSec float64) *tokenBucket {
+	return &tokenBucket{capacity: ratePerSec, tokens: ratePerSec, rate: ratePerSec, last: time.Now()}
+}
+
+// take consumes n tokens, refilling for elapsed time first, and returns how
+// long the caller should wait before those bytes are considered "sent".
+func (b *tokenBucket) take(n int64) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limiter enforces a per-host and a global byte/sec cap and accounts for
+// how much was transferred (and how often a host got throttled), so a run
+// can report something like "12.3 MB pulled at 4.1 MB/s, 2 hosts throttled".
+type Limiter struct {
+	perHostCap float64
+	global     *tokenBucket
+
+	mtx        sync.Mutex
+	perHost    map[string]*tokenBucket
+	throttled  map[string]bool
+	totalBytes int64
+}
+
+// NewLimiter returns a Limiter capping each host at perHostBytesPerSec and
+// the fleet as a whole at globalBytesPerSec. A cap of 0 means unlimited.
+func NewLimiter(perHostBytesPerSec, globalBytesPerSec float64) *Limiter {
+	return &Limiter{
+		perHostCap: perHostBytesPerSec,
+		global:     newTokenBucket(globalBytesPerSec),
+		perHost:    map[string]*tokenBucket{},
+		throttled:  map[string]bool{},
+	}
+}
+
+func (l *Limiter) hostBucket(host string) *tokenBucket {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, ok := l.perHost[host]
+	if !ok {
+		b = newTokenBucket(l.perHostCap)
+		l.perHost[host] = b
+	}
+	return b
+}
+
+// Wrap returns r decorated to record bytes read for host into the
+// Limiter's totals and to block once the per-host or global cap is hit.
+func (l *Limiter) Wrap(host string, r io.Reader) io.Reader {
+	return &limitedReader{host: host, r: r, limiter: l}
+}
+
+func (l *Limiter) account(host string, n int64) {
+	atomic.AddInt64(&l.totalBytes, n)
+
+	var wait time.Duration
+	if l.perHostCap > 0 {
+		wait = l.hostBucket(host).take(n)
+	}
+	if l.global.rate > 0 {
+		if gwait := l.global.take(n); gwait > wait {
+			wait = gwait
+		}
+	}
+	if wait > 0 {
+		l.mtx.Lock()
+		l.throttled[host] = true
+		l.mtx.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// Report summarizes total bytes pulled, the effective throughput over
+// elapsed, and how many distinct hosts were throttled at least once.
+func (l *Limiter) Report(elapsed time.Duration) string {
+	total := atomic.LoadInt64(&l.totalBytes)
+	mb := float64(total) / (1024 * 1024)
+	mbps := 0.0
+	if elapsed > 0 {
+		mbps = mb / elapsed.Seconds()
+	}
+	l.mtx.Lock()
+	throttled := len(l.throttled)
+	l.mtx.Unlock()
+	return fmt.Sprintf("%.1f MB pulled at %.1f MB/s, %d hosts throttled", mb, mbps, throttled)
+}
+
+type limitedReader struct {
+	host    string
+	r       io.Reader
+	limiter *Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		lr.limiter.account(lr.host, int64(n))
+	}
+	return n, err
+}
+
+// withSimulatedFailures wraps next so a fraction of calls (0..1) are
+// answered with a synthetic retryable 5xx instead of actually fetching,
+// for chaos-testing the retry/backoff path against an unstable network.
+func withSimulatedFailures(rate float64, next fetcher) fetcher {
+	if rate <= 0 {
+		return next
+	}
+	return func(u url.URL) payload {
+		if rand.Float64() < rate {
+			return payload{url: u, canRetry: true}
+		}
+		return next(u)
+	}
+}
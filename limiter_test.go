@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math/rand"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestTokenBucketTakeWithinCapacity checks that taking no more than the
+// bucket currently holds never reports a wait.
+func TestTokenBucketTakeWithinCapacity(t *testing.T) {
+	b := newTokenBucket(100)
+	if wait := b.take(50); wait != 0 {
+		t.Errorf("take(50) on a fresh 100-capacity bucket = %v, want 0", wait)
+	}
+}
+
+// TestTokenBucketTakeExhaustionWaits checks that taking more than the
+// bucket holds returns a wait proportional to the deficit and rate, per
+// take's own formula: wait = -tokens/rate seconds.
+func TestTokenBucketTakeExhaustionWaits(t *testing.T) {
+	b := newTokenBucket(10)
+	b.take(10) // drain the initial full bucket
+	wait := b.take(5)
+	// 5 tokens short at a 10/sec refill rate should be ~0.5s; allow slop
+	// for the real time elapsed between take() calls in this test.
+	if wait < 400*time.Millisecond || wait > 600*time.Millisecond {
+		t.Errorf("take(5) after exhausting a 10/sec bucket = %v, want ~500ms", wait)
+	}
+}
+
+// TestTokenBucketTakeRefillsOverTime checks that tokens accumulate between
+// calls, so a bucket given enough time to refill stops reporting a wait.
+func TestTokenBucketTakeRefillsOverTime(t *testing.T) {
+	b := newTokenBucket(1000)
+	b.take(1000)
+	time.Sleep(50 * time.Millisecond)
+	if wait := b.take(10); wait != 0 {
+		t.Errorf("take(10) after a refill window = %v, want 0", wait)
+	}
+}
+
+// TestTokenBucketUnlimitedRate checks that rate <= 0 (the "unlimited"
+// sentinel NewLimiter documents) never reports a wait regardless of how
+// many tokens are taken.
+func TestTokenBucketUnlimitedRate(t *testing.T) {
+	b := newTokenBucket(0)
+	if wait := b.take(1 << 30); wait != 0 {
+		t.Errorf("take on a rate<=0 bucket = %v, want 0", wait)
+	}
+}
+
+// TestLimiterAccountPicksTheLargerWait checks that account blocks for
+// whichever of the per-host or global cap demands the longer wait, using a
+// tight global cap and a loose per-host cap.
+func TestLimiterAccountPicksTheLargerWait(t *testing.T) {
+	l := NewLimiter(1<<30, 1000) // per-host effectively unlimited, global cap tight
+	start := time.Now()
+	l.account("a.example.com", 1100) // 100 bytes over the 1000-byte global bucket
+	elapsed := time.Since(start)
+	if elapsed < 80*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("account blocked for %v, want ~100ms given a 1000/sec global cap and a 100-byte deficit", elapsed)
+	}
+	if total := l.Report(elapsed); total == "" {
+		t.Error("Report returned an empty summary")
+	}
+}
+
+// TestLimiterAccountTracksThrottledHosts checks that a host which actually
+// had to wait is recorded, and shows up in Report's throttled-host count.
+func TestLimiterAccountTracksThrottledHosts(t *testing.T) {
+	l := NewLimiter(1000, 0)
+	l.account("busy.example.com", 1100) // exceeds the 1000 bytes/sec cap, must throttle
+	l.mtx.Lock()
+	throttled := l.throttled["busy.example.com"]
+	l.mtx.Unlock()
+	if !throttled {
+		t.Error("expected busy.example.com to be recorded as throttled")
+	}
+}
+
+// TestLimiterAccountNoCapsNeverWaits checks that a Limiter constructed
+// with both caps at 0 (NewLimiter's documented "unlimited") never blocks.
+func TestLimiterAccountNoCapsNeverWaits(t *testing.T) {
+	l := NewLimiter(0, 0)
+	start := time.Now()
+	l.account("a.example.com", 1<<30)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("account with no caps took %v, want near-instant", elapsed)
+	}
+}
+
+// TestWithSimulatedFailuresZeroRateIsANoOp checks that a rate of 0 returns
+// next unchanged rather than wrapping it, since withSimulatedFailures
+// documents rate<=0 as "disabled".
+func TestWithSimulatedFailuresZeroRateIsANoOp(t *testing.T) {
+	calls := 0
+	next := func(u url.URL) payload { calls++; return payload{url: u} }
+	f := withSimulatedFailures(0, next)
+	f(url.URL{})
+	if calls != 1 {
+		t.Fatalf("next called %d times through a zero-rate wrapper, want 1", calls)
+	}
+}
+
+// TestWithSimulatedFailuresRateOneAlwaysFails checks that a rate of 1
+// injects a synthetic retryable failure on every call instead of ever
+// reaching next.
+func TestWithSimulatedFailuresRateOneAlwaysFails(t *testing.T) {
+	calls := 0
+	next := func(u url.URL) payload { calls++; return payload{url: u} }
+	f := withSimulatedFailures(1, next)
+
+	for i := 0; i < 20; i++ {
+		p := f(url.URL{})
+		if !p.canRetry || p.err != nil {
+			t.Fatalf("call %d: got %+v, want a retryable synthetic failure", i, p)
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("next called %d times through a rate=1 wrapper, want 0", calls)
+	}
+}
+
+// TestWithSimulatedFailuresIsSeeded is a smoke test that a fractional rate
+// produces a mix of injected failures and real calls, rather than always
+// doing one or the other (which would indicate rand.Float64 isn't being
+// consulted per call).
+func TestWithSimulatedFailuresIsSeeded(t *testing.T) {
+	rand.Seed(1)
+	calls := 0
+	next := func(u url.URL) payload { calls++; return payload{url: u} }
+	f := withSimulatedFailures(0.5, next)
+
+	injected := 0
+	for i := 0; i < 200; i++ {
+		if p := f(url.URL{}); p.canRetry {
+			injected++
+		}
+	}
+	if calls == 0 || injected == 0 {
+		t.Fatalf("got %d real calls and %d injected failures out of 200, want a mix of both", calls, injected)
+	}
+}
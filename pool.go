@@ -0,0 +1,197 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queueItem is one URL waiting in a Pool's priority queue, ordered by when
+// it is next eligible to be fetched.
+type queueItem struct {
+	url           url.URL
+	nextAttemptAt time.Time
+}
+
+// itemQueue is a container/heap.Interface ordering queueItems by
+// nextAttemptAt, so workers always pull whichever URL is next due.
+type itemQueue []*queueItem
+
+func (q itemQueue) Len() int            { return len(q) }
+func (q itemQueue) Less(i, j int) bool  { return q[i].nextAttemptAt.Before(q[j].nextAttemptAt) }
+func (q itemQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *itemQueue) Push(x interface{}) { *q = append(*q, x.(*queueItem)) }
+func (q *itemQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// Pool is a long-lived set of workers draining a priority/retry queue.
+// Unlike a restart-per-cycle loop, workers are started once and retryable
+// failures simply re-enqueue themselves with a future nextAttemptAt; the
+// pool only shuts down once the queue is empty and no worker is in flight.
+type Pool struct {
+	f  fetcher
+	rp retryPolicy
+
+	mtx      sync.Mutex
+	pq       itemQueue
+	attempts map[string]int
+	prevWait map[string]time.Duration
+	bytes    map[string]int64
+	results  map[string]payload
+
+	inFlight int64
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewPool returns a Pool that fetches with f and retries according to rp.
+func NewPool(f fetcher, rp retryPolicy) *Pool {
+	p := &Pool{
+		f:        f,
+		rp:       rp,
+		attempts: map[string]int{},
+		prevWait: map[string]time.Duration{},
+		bytes:    map[string]int64{},
+		results:  map[string]payload{},
+		done:     make(chan struct{}),
+	}
+	heap.Init(&p.pq)
+	return p
+}
+
+// Run starts poolSize workers against urls and blocks until every URL has
+// either succeeded or exhausted its retry budget, returning the successful
+// payloads.
+func (p *Pool) Run(urls []url.URL, poolSize int) ([]payload, time.Duration) {
+	start := time.Now().UTC()
+
+	now := time.Now()
+	p.mtx.Lock()
+	for _, u := range urls {
+		heap.Push(&p.pq, &queueItem{url: u, nextAttemptAt: now})
+	}
+	p.mtx.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < poolSize; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			p.runWorker(id)
+		}(i)
+	}
+	p.checkDone()
+	wg.Wait()
+
+	var final []payload
+	for _, v := range p.results {
+		if v.err == nil {
+			final = append(final, v)
+		} else {
+			log.Println("skipping", v.url.String(), ":", v.err)
+		}
+	}
+	return final, time.Since(start)
+}
+
+// checkDone closes p.done once the queue is empty and no worker holds an
+// in-flight fetch, which is the only condition under which the pool exits.
+func (p *Pool) checkDone() {
+	p.mtx.Lock()
+	empty := len(p.pq) == 0
+	p.mtx.Unlock()
+	if empty && atomic.LoadInt64(&p.inFlight) == 0 {
+		p.doneOnce.Do(func() { close(p.done) })
+	}
+}
+
+// pollInterval bounds how long a worker sleeps while waiting for either the
+// queue's next scheduled item or the pool to finish.
+const pollInterval = 20 * time.Millisecond
+
+func (p *Pool) runWorker(id int) {
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		p.mtx.Lock()
+		if len(p.pq) == 0 {
+			p.mtx.Unlock()
+			p.checkDone()
+			select {
+			case <-p.done:
+				return
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+
+		wait := time.Until(p.pq[0].nextAttemptAt)
+		if wait > 0 {
+			p.mtx.Unlock()
+			if wait > pollInterval {
+				wait = pollInterval
+			}
+			time.Sleep(wait)
+			continue
+		}
+
+		item := heap.Pop(&p.pq).(*queueItem)
+		atomic.AddInt64(&p.inFlight, 1)
+		key := item.url.String()
+		p.attempts[key]++
+		attempt := p.attempts[key]
+		p.mtx.Unlock()
+
+		log.Println("Worker ", id, "got", item.url.String(), "attempt", attempt)
+		now := time.Now().UTC()
+		res := p.f(item.url)
+		res.attempt = attempt
+		res.elapsed = time.Since(now)
+
+		p.mtx.Lock()
+		// bytes accumulate across every attempt, including ones that were
+		// ultimately retried, so the final payload reflects total transfer.
+		p.bytes[key] += res.bytes
+		res.bytes = p.bytes[key]
+		switch {
+		case res.err == nil && !res.canRetry:
+			p.results[key] = res
+		case res.canRetry && attempt < p.rp.maxAttempts:
+			prev := p.prevWait[key]
+			if prev == 0 {
+				prev = p.rp.baseDelay
+			}
+			delay := p.rp.backoff(prev)
+			p.prevWait[key] = delay
+			if res.retryAfter > delay {
+				delay = res.retryAfter
+			}
+			heap.Push(&p.pq, &queueItem{url: item.url, nextAttemptAt: time.Now().Add(delay)})
+		default:
+			if res.canRetry {
+				res.canRetry = false
+				res.err = errors.New(fmt.Sprintf("giving up after %d attempts", attempt))
+			}
+			p.results[key] = res
+		}
+		p.mtx.Unlock()
+
+		atomic.AddInt64(&p.inFlight, -1)
+		p.checkDone()
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRetryPolicy() retryPolicy {
+	return retryPolicy{maxAttempts: 3, baseDelay: time.Millisecond, maxDelay: 10 * time.Millisecond}
+}
+
+// TestPoolRetriesThenSucceeds checks that a 5xx-style retryable payload is
+// retried and the pool still returns the eventual success.
+func TestPoolRetriesThenSucceeds(t *testing.T) {
+	u := url.URL{Scheme: "http", Host: "example.com", Path: "/a"}
+	var attempts int64
+
+	f := func(got url.URL) payload {
+		n := atomic.AddInt64(&attempts, 1)
+		if n < 3 {
+			return payload{url: got, canRetry: true}
+		}
+		return payload{url: got, numUsers: 1}
+	}
+
+	results, _ := NewPool(f, testRetryPolicy()).Run([]url.URL{u}, 2)
+	if atomic.LoadInt64(&attempts) != 3 {
+		t.Fatalf("fetcher called %d times, want 3", attempts)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].numUsers != 1 {
+		t.Fatalf("got %d users in result, want 1", results[0].numUsers)
+	}
+}
+
+// TestPoolGivesUpAfterMaxAttempts checks that a URL that never stops being
+// retryable is dropped (not returned as a success) once maxAttempts is hit.
+func TestPoolGivesUpAfterMaxAttempts(t *testing.T) {
+	u := url.URL{Scheme: "http", Host: "example.com", Path: "/a"}
+	var attempts int64
+
+	f := func(got url.URL) payload {
+		atomic.AddInt64(&attempts, 1)
+		return payload{url: got, canRetry: true}
+	}
+
+	rp := testRetryPolicy()
+	results, _ := NewPool(f, rp).Run([]url.URL{u}, 2)
+	if atomic.LoadInt64(&attempts) != int64(rp.maxAttempts) {
+		t.Fatalf("fetcher called %d times, want %d", attempts, rp.maxAttempts)
+	}
+	if len(results) != 0 {
+		t.Fatalf("got %d results, want 0 (giving up should not count as success)", len(results))
+	}
+}
+
+// TestPoolNonRetryableErrorStopsImmediately checks that a non-retryable
+// error is neither retried nor returned as a success.
+func TestPoolNonRetryableErrorStopsImmediately(t *testing.T) {
+	u := url.URL{Scheme: "http", Host: "example.com", Path: "/a"}
+	var attempts int64
+
+	f := func(got url.URL) payload {
+		atomic.AddInt64(&attempts, 1)
+		return payload{url: got, err: errNonRetryable}
+	}
+
+	results, _ := NewPool(f, testRetryPolicy()).Run([]url.URL{u}, 2)
+	if atomic.LoadInt64(&attempts) != 1 {
+		t.Fatalf("fetcher called %d times, want 1", attempts)
+	}
+	if len(results) != 0 {
+		t.Fatalf("got %d results, want 0", len(results))
+	}
+}
+
+// TestPoolRunsEveryURL checks that every URL handed to Run is fetched
+// exactly once when every fetch succeeds immediately.
+func TestPoolRunsEveryURL(t *testing.T) {
+	urls := []url.URL{
+		{Scheme: "http", Host: "example.com", Path: "/a"},
+		{Scheme: "http", Host: "example.com", Path: "/b"},
+		{Scheme: "http", Host: "example.com", Path: "/c"},
+	}
+	seen := make(chan string, len(urls))
+	f := func(got url.URL) payload {
+		seen <- got.String()
+		return payload{url: got}
+	}
+
+	results, _ := NewPool(f, testRetryPolicy()).Run(urls, 3)
+	close(seen)
+	if len(results) != len(urls) {
+		t.Fatalf("got %d results, want %d", len(results), len(urls))
+	}
+	count := 0
+	for range seen {
+		count++
+	}
+	if count != len(urls) {
+		t.Fatalf("fetcher called %d times, want %d", count, len(urls))
+	}
+}
+
+type testError string
+
+func (e testError) Error() string { return string(e) }
+
+const errNonRetryable = testError("boom")
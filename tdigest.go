@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// defaultTDigestCompression gives ~1% quantile error with a few hundred
+// centroids regardless of how many values are added.
+const defaultTDigestCompression = 100
+
+// centroid is a weighted mean: weight values have been folded into mean.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigest is a streaming quantile sketch. It maintains a small set of
+// weighted centroids sorted by mean and bounds each centroid's weight by
+// how close to the tails it sits, so Quantile stays accurate near the
+// extremes and approximate near the middle. Safe for concurrent use; per-
+// worker digests can be combined cheaply with Merge instead of sharing a
+// single lock.
+type TDigest struct {
+	mtx         sync.Mutex
+	compression float64
+	centroids   []centroid
+	count       float64
+}
+
+// NewTDigest returns a digest with the given compression. Higher
+// compression keeps more centroids and gives tighter quantile estimates at
+// the cost of more memory; compression <= 0 falls back to the default.
+func NewTDigest(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = defaultTDigestCompression
+	}
+	return &TDigest{compression: compression}
+}
+
+// Add folds x into the digest with weight 1.
+func (t *TDigest) Add(x float64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.add(x, 1)
+}
+
+// add merges x into the nearest centroid if that centroid has room under
+// the size bound 4*total*q*(1-q)/compression, otherwise inserts x as a new
+// centroid at its sorted position. Must be called with t.mtx held.
+func (t *TDigest) add(x, w float64) {
+	if len(t.centroids) == 0 {
+		t.centroids = append(t.centroids, centroid{mean: x, weight: w})
+		t.count += w
+		return
+	}
+
+	idx := sort.Search(len(t.centroids), func(i int) bool { return t.centroids[i].mean >= x })
+	nearest := idx
+	switch {
+	case idx == len(t.centroids):
+		nearest = idx - 1
+	case idx > 0 && x-t.centroids[idx-1].mean < t.centroids[idx].mean-x:
+		nearest = idx - 1
+	}
+
+	var cum float64
+	for i := 0; i < nearest; i++ {
+		cum += t.centroids[i].weight
+	}
+	total := t.count + w
+	q := (cum + t.centroids[nearest].weight/2) / total
+	maxWeight := 4 * total * q * (1 - q) / t.compression
+
+	if t.centroids[nearest].weight+w <= maxWeight {
+		c := &t.centroids[nearest]
+		c.mean += w * (x - c.mean) / (c.weight + w)
+		c.weight += w
+		t.count += w
+		return
+	}
+
+	t.centroids = append(t.centroids, centroid{})
+	copy(t.centroids[idx+1:], t.centroids[idx:len(t.centroids)-1])
+	t.centroids[idx] = centroid{mean: x, weight: w}
+	t.count += w
+
+	// bound memory growth by periodically re-inserting in random order,
+	// which spreads centroids back out instead of leaving them clumped
+	// around whatever insertion order produced the overflow.
+	if len(t.centroids) > int(20*t.compression) {
+		t.compact()
+	}
+}
+
+func (t *TDigest) compact() {
+	old := t.centroids
+	t.centroids = nil
+	t.count = 0
+	for _, i := range rand.Perm(len(old)) {
+		t.add(old[i].mean, old[i].weight)
+	}
+}
+
+// Mean returns the weighted mean of every value added to the digest.
+func (t *TDigest) Mean() float64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.count == 0 {
+		return 0
+	}
+	var sum float64
+	for _, c := range t.centroids {
+		sum += c.mean * c.weight
+	}
+	return sum / t.count
+}
+
+// Median is shorthand for Quantile(0.5).
+func (t *TDigest) Median() float64 {
+	return t.Quantile(0.5)
+}
+
+// Quantile estimates the value at rank q (0..1) in O(centroids) by walking
+// cumulative centroid weight and interpolating between centroid means.
+func (t *TDigest) Quantile(q float64) float64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].mean
+	}
+
+	target := q * t.count
+	var cum float64
+	for i, c := range t.centroids {
+		next := cum + c.weight
+		if i == 0 && target <= next {
+			return c.mean
+		}
+		if target <= next || i == len(t.centroids)-1 {
+			prev := t.centroids[i-1]
+			frac := (target - cum) / c.weight
+			return prev.mean + frac*(c.mean-prev.mean)
+		}
+		cum = next
+	}
+	return t.centroids[len(t.centroids)-1].mean
+}
+
+// Merge folds every centroid of other into t, letting per-worker digests be
+// combined without sharing a lock while they're being built.
+func (t *TDigest) Merge(other *TDigest) {
+	other.mtx.Lock()
+	centroids := make([]centroid, len(other.centroids))
+	copy(centroids, other.centroids)
+	other.mtx.Unlock()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, c := range centroids {
+		t.add(c.mean, c.weight)
+	}
+}
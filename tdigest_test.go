@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTDigestQuantileUniform(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const n = 100000
+	values := make([]float64, n)
+	td := NewTDigest(100)
+	for i := range values {
+		v := rng.Float64() * 1000
+		values[i] = v
+		td.Add(v)
+	}
+	sort.Float64s(values)
+
+	for _, q := range []float64{0.01, 0.25, 0.5, 0.75, 0.99} {
+		want := values[int(q*float64(n))]
+		got := td.Quantile(q)
+		// 1% compression should keep estimates within a couple of percent
+		// of the true value for a uniform distribution this size.
+		if math.Abs(got-want) > 0.02*1000 {
+			t.Errorf("Quantile(%v) = %v, want close to %v", q, got, want)
+		}
+	}
+}
+
+func TestTDigestMeanAndMedian(t *testing.T) {
+	td := NewTDigest(100)
+	for _, v := range []float64{1, 2, 3, 4, 5} {
+		td.Add(v)
+	}
+	if mean := td.Mean(); mean != 3 {
+		t.Errorf("Mean() = %v, want 3", mean)
+	}
+	if median := td.Median(); math.Abs(median-3) > 1 {
+		t.Errorf("Median() = %v, want close to 3", median)
+	}
+}
+
+func TestTDigestEmpty(t *testing.T) {
+	td := NewTDigest(100)
+	if mean := td.Mean(); mean != 0 {
+		t.Errorf("Mean() on empty digest = %v, want 0", mean)
+	}
+	if q := td.Quantile(0.5); q != 0 {
+		t.Errorf("Quantile(0.5) on empty digest = %v, want 0", q)
+	}
+}
+
+// TestStreamPayloadBuildsPerFileDigest checks that streamPayload folds ages
+// into its own t-digest as rows are parsed, rather than handing back a
+// slice of every user - summarize relies on this to merge per-file digests
+// without ever holding every row from every file in memory at once.
+func TestStreamPayloadBuildsPerFileDigest(t *testing.T) {
+	csv := "fname, lname, age\nAda,Lovelace,36\nAlan,Turing,41\n"
+	u := url.URL{Scheme: "file", Path: "/users.csv"}
+	p := streamPayload(u, io.NopCloser(strings.NewReader(csv)))
+	if p.err != nil {
+		t.Fatalf("streamPayload: %v", p.err)
+	}
+	if p.numUsers != 2 {
+		t.Fatalf("numUsers = %d, want 2", p.numUsers)
+	}
+	if p.ages == nil {
+		t.Fatal("expected a per-file t-digest on the payload")
+	}
+	if mean := p.ages.Mean(); math.Abs(mean-38.5) > 0.01 {
+		t.Errorf("ages.Mean() = %v, want 38.5", mean)
+	}
+}
+
+// TestSummarizeMergesPerFileDigests checks that summarize combines
+// multiple payloads' digests (via TDigest.Merge) into one, instead of
+// needing every payload's full row set concatenated first.
+func TestSummarizeMergesPerFileDigests(t *testing.T) {
+	a := NewTDigest(100)
+	a.Add(10)
+	a.Add(20)
+	b := NewTDigest(100)
+	b.Add(30)
+	b.Add(40)
+
+	payloads := []payload{
+		{url: url.URL{Path: "/a.csv"}, ages: a, numUsers: 2},
+		{url: url.URL{Path: "/b.csv"}, ages: b, numUsers: 2},
+	}
+
+	merged := NewTDigest(100)
+	total := 0
+	for _, p := range payloads {
+		total += p.numUsers
+		merged.Merge(p.ages)
+	}
+	if total != 4 {
+		t.Fatalf("total = %d, want 4", total)
+	}
+	if mean := merged.Mean(); math.Abs(mean-25) > 0.01 {
+		t.Errorf("merged mean = %v, want 25", mean)
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	a := NewTDigest(100)
+	b := NewTDigest(100)
+	for i := 1; i <= 50; i++ {
+		a.Add(float64(i))
+	}
+	for i := 51; i <= 100; i++ {
+		b.Add(float64(i))
+	}
+	a.Merge(b)
+	if median := a.Median(); math.Abs(median-50.5) > 2 {
+		t.Errorf("Median() after merge = %v, want close to 50.5", median)
+	}
+}
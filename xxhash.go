@@ -0,0 +1,146 @@
+package main
+
+import "encoding/binary"
+
+// xxHash64 prime constants, as specified by the xxHash reference algorithm.
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXHash64 is a streaming implementation of 64-bit xxHash: it folds input
+// in 32-byte blocks into four accumulators, then merges and avalanches the
+// result on Sum64. It is a fast, non-cryptographic hash - used here only to
+// derive cache keys, not for integrity against adversarial input.
+type XXHash64 struct {
+	seed           uint64
+	v1, v2, v3, v4 uint64
+	total          uint64
+	buf            [32]byte
+	bufUsed        int
+}
+
+// NewXXHash64 returns a ready-to-use hasher seeded with seed.
+func NewXXHash64(seed uint64) *XXHash64 {
+	h := &XXHash64{seed: seed}
+	h.Reset()
+	return h
+}
+
+// Reset restores the hasher to its initial state so it can be reused.
+func (h *XXHash64) Reset() {
+	h.v1 = h.seed + xxPrime1 + xxPrime2
+	h.v2 = h.seed + xxPrime2
+	h.v3 = h.seed
+	h.v4 = h.seed - xxPrime1
+	h.total = 0
+	h.bufUsed = 0
+}
+
+func xxRotl(x uint64, r uint) uint64 { return (x << r) | (x >> (64 - r)) }
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = xxRotl(acc, 31)
+	acc *= xxPrime1
+	return acc
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	acc = acc*xxPrime1 + xxPrime4
+	return acc
+}
+
+// Write folds input into the four running accumulators, carrying any
+// partial 32-byte block across calls so callers can stream arbitrarily
+// sized chunks (e.g. via io.TeeReader) without buffering the whole input.
+func (h *XXHash64) Write(input []byte) (int, error) {
+	n := len(input)
+	h.total += uint64(n)
+
+	if h.bufUsed+n < 32 {
+		copy(h.buf[h.bufUsed:], input)
+		h.bufUsed += n
+		return n, nil
+	}
+
+	data := input
+	if h.bufUsed > 0 {
+		fill := 32 - h.bufUsed
+		copy(h.buf[h.bufUsed:], data[:fill])
+		h.v1 = xxRound(h.v1, binary.LittleEndian.Uint64(h.buf[0:8]))
+		h.v2 = xxRound(h.v2, binary.LittleEndian.Uint64(h.buf[8:16]))
+		h.v3 = xxRound(h.v3, binary.LittleEndian.Uint64(h.buf[16:24]))
+		h.v4 = xxRound(h.v4, binary.LittleEndian.Uint64(h.buf[24:32]))
+		data = data[fill:]
+		h.bufUsed = 0
+	}
+
+	for len(data) >= 32 {
+		h.v1 = xxRound(h.v1, binary.LittleEndian.Uint64(data[0:8]))
+		h.v2 = xxRound(h.v2, binary.LittleEndian.Uint64(data[8:16]))
+		h.v3 = xxRound(h.v3, binary.LittleEndian.Uint64(data[16:24]))
+		h.v4 = xxRound(h.v4, binary.LittleEndian.Uint64(data[24:32]))
+		data = data[32:]
+	}
+
+	if len(data) > 0 {
+		copy(h.buf[:], data)
+		h.bufUsed = len(data)
+	}
+	return n, nil
+}
+
+// Sum64 merges the accumulators (or falls back to the short-input path),
+// folds in any trailing bytes shorter than 8/4/1 bytes, and finalizes with
+// the avalanche step.
+func (h *XXHash64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = xxRotl(h.v1, 1) + xxRotl(h.v2, 7) + xxRotl(h.v3, 12) + xxRotl(h.v4, 18)
+		acc = xxMergeRound(acc, h.v1)
+		acc = xxMergeRound(acc, h.v2)
+		acc = xxMergeRound(acc, h.v3)
+		acc = xxMergeRound(acc, h.v4)
+	} else {
+		acc = h.seed + xxPrime5
+	}
+	acc += h.total
+
+	data := h.buf[:h.bufUsed]
+	for len(data) >= 8 {
+		k1 := xxRound(0, binary.LittleEndian.Uint64(data[0:8]))
+		acc ^= k1
+		acc = xxRotl(acc, 27)*xxPrime1 + xxPrime4
+		data = data[8:]
+	}
+	if len(data) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(data[0:4])) * xxPrime1
+		acc = xxRotl(acc, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for len(data) > 0 {
+		acc ^= uint64(data[0]) * xxPrime5
+		acc = xxRotl(acc, 11) * xxPrime1
+		data = data[1:]
+	}
+
+	acc ^= acc >> 33
+	acc *= xxPrime2
+	acc ^= acc >> 29
+	acc *= xxPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+// xxhash64 is a convenience one-shot hash for a single byte slice.
+func xxhash64(data []byte) uint64 {
+	h := NewXXHash64(0)
+	h.Write(data)
+	return h.Sum64()
+}